@@ -2,7 +2,9 @@ package master
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/concurrency"
@@ -14,8 +16,19 @@ const (
 	DefaultLockPath = "/master/lock"
 	// DefaultStatePath is the default etcd key for master state.
 	DefaultStatePath = "/master/state"
+
+	// defaultLeaseTTLSec is the TTL, in seconds, used for leases that
+	// a LeaseManager grants to pool per-trainer or per-task keys.
+	defaultLeaseTTLSec = 60
 )
 
+// ErrNotLeader is returned by NewEtcdTry when another master already
+// holds the lock, and by Save/SaveCtx/Load/LoadCtx when called on a
+// standby Etcd that has not yet been promoted to leader. The returned
+// *Etcd is still usable: its session stays alive and LeaderCh fires
+// once this instance is promoted.
+var ErrNotLeader = errors.New("master: not the leader")
+
 // Etcd is the etcd abstraction that master uses for fault tolerance
 // and service registry.
 type Etcd struct {
@@ -24,30 +37,50 @@ type Etcd struct {
 	ttlSec    int
 	client    *clientv3.Client
 
-	mu   sync.Mutex
-	lock *concurrency.Mutex
+	mu       sync.Mutex
+	sess     *concurrency.Session
+	lock     *concurrency.Mutex
+	leading  bool
+	leaderCh chan bool
+
+	leases *LeaseManager
 }
 
-// NewEtcd creates a new Etcd.
-func NewEtcd(endpoints []string, lockPath, statePath string, ttlSec int) (*Etcd, error) {
-	// TODO(helin): gracefully shutdown etcd store. Becuase etcd
-	// store holds a etcd lock, even though the lock will expire
-	// when the lease timeout, we need to implement graceful
-	// shutdown to release the lock.
+// newEtcdSession dials endpoints, starts a LeaseManager, and obtains
+// from it the lease backing a concurrency.Session and
+// concurrency.Mutex on lockPath, without attempting to acquire the
+// lock. It is shared by NewEtcd and NewEtcdTry.
+func newEtcdSession(endpoints []string, lockPath string, ttlSec int) (*clientv3.Client, *LeaseManager, *concurrency.Session, *concurrency.Mutex, error) {
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints:   endpoints,
 		DialTimeout: dialTimeout,
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, nil, err
+	}
+
+	leases := NewLeaseManager(cli)
+	leaseID, err := leases.Grant(context.TODO(), ttlSec)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	sess, err := concurrency.NewSession(cli, concurrency.WithLease(leaseID))
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 
-	sess, err := concurrency.NewSession(cli, concurrency.WithTTL(ttlSec))
+	return cli, leases, sess, concurrency.NewMutex(sess, lockPath), nil
+}
+
+// NewEtcd creates a new Etcd. It blocks until the master lock at
+// lockPath is acquired.
+func NewEtcd(endpoints []string, lockPath, statePath string, ttlSec int) (*Etcd, error) {
+	cli, leases, sess, lock, err := newEtcdSession(endpoints, lockPath, ttlSec)
 	if err != nil {
 		return nil, err
 	}
 
-	lock := concurrency.NewMutex(sess, lockPath)
 	// It's fine for the lock to get stuck, in this case we have
 	// multiple master servers running (only configured to have
 	// one master running, but split-brain problem may cuase
@@ -62,81 +95,355 @@ func NewEtcd(endpoints []string, lockPath, statePath string, ttlSec int) (*Etcd,
 
 	e := &Etcd{}
 	e.client = cli
+	e.leases = leases
+	e.sess = sess
 	e.lock = lock
 	e.lockPath = lockPath
 	e.statePath = statePath
 	e.ttlSec = ttlSec
+	e.leading = true
 	return e, nil
 }
 
-// Save saves the state into the etcd.
+// NewEtcdTry is like NewEtcd but does not block waiting for the lock:
+// it attempts to acquire the lock once and, if another master already
+// holds it, returns ErrNotLeader while keeping the session alive. The
+// caller can run the returned *Etcd as a hot standby (serving health
+// checks, metrics, or read-only RPCs) and wait on LeaderCh for
+// promotion, instead of blocking inside NewEtcd until it becomes
+// leader.
+func NewEtcdTry(endpoints []string, lockPath, statePath string, ttlSec int) (*Etcd, error) {
+	cli, leases, sess, lock, err := newEtcdSession(endpoints, lockPath, ttlSec)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Etcd{}
+	e.client = cli
+	e.leases = leases
+	e.sess = sess
+	e.lock = lock
+	e.lockPath = lockPath
+	e.statePath = statePath
+	e.ttlSec = ttlSec
+	e.leaderCh = make(chan bool, 1)
+
+	log.Infof("Trying to acquire lock at %s without blocking.", lockPath)
+	err = lock.TryLock(context.TODO())
+	if err == nil {
+		log.Infof("Successfully acquired lock at %s.", lockPath)
+		e.leading = true
+		e.notifyLeaderCh(true)
+		return e, nil
+	}
+	if err != concurrency.ErrLocked {
+		return nil, err
+	}
+
+	log.Infof("Lock at %s is held by another master, running as standby.", lockPath)
+	go e.campaign()
+	return e, ErrNotLeader
+}
+
+// campaign blocks on the master lock on behalf of a standby Etcd
+// created by NewEtcdTry, and notifies LeaderCh once this instance is
+// promoted to leader. It takes e.mu around every access to e.lock,
+// since Save/SaveCtx/Load/LoadCtx/Close may read or replace that
+// field concurrently from other goroutines.
+func (e *Etcd) campaign() {
+	log.Infof("Standby master campaigning for lock at %s.", e.lockPath)
+
+	e.mu.Lock()
+	lock := e.lock
+	e.mu.Unlock()
+
+	if err := lock.Lock(context.TODO()); err != nil {
+		log.Errorln(err)
+		return
+	}
+
+	e.mu.Lock()
+	e.leading = true
+	e.mu.Unlock()
+
+	log.Infof("Promoted to leader at %s.", e.lockPath)
+	e.notifyLeaderCh(true)
+}
+
+// notifyLeaderCh sends leading on LeaderCh without blocking if no one
+// is receiving. It is a no-op for Etcd instances created with NewEtcd,
+// which never populate leaderCh.
+func (e *Etcd) notifyLeaderCh(leading bool) {
+	if e.leaderCh == nil {
+		return
+	}
+	select {
+	case e.leaderCh <- leading:
+	default:
+	}
+}
+
+// LeaderCh returns a channel that receives true when this Etcd
+// instance becomes the leader, and false when a Save/Load call finds
+// that it no longer owns the lock, e.g. because its session died; the
+// call then tries to reacquire the lock and sends true again once it
+// succeeds. Sends never block: a value is dropped while the channel's
+// one-slot buffer still holds an unread one. It is only populated for
+// instances created with NewEtcdTry; NewEtcd already blocks until it
+// is the leader, so it never sends on this channel.
+func (e *Etcd) LeaderCh() <-chan bool {
+	return e.leaderCh
+}
+
+// Leases returns the LeaseManager backing this Etcd's lock session,
+// so callers such as the task scheduler can register ephemeral
+// per-trainer or per-task keys that vanish automatically if the
+// owning process dies.
+func (e *Etcd) Leases() *LeaseManager {
+	return e.leases
+}
+
+// Close releases the etcd lock, revokes the session's lease, and
+// closes the underlying etcd client. This allows a rolling restart
+// of masters to fail over in milliseconds, instead of waiting for
+// the lease to expire after ttlSec seconds.
+func (e *Etcd) Close(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	log.Infof("Releasing lock at %s.", e.lockPath)
+	err := e.lock.Unlock(ctx)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	err = e.sess.Close()
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	return e.client.Close()
+}
+
+// defaultTimeout returns the default per-call timeout derived from
+// ttlSec, used by Save and Load to bound how long they wait on a
+// stuck etcd leader.
+func (e *Etcd) defaultTimeout() time.Duration {
+	return time.Duration(e.ttlSec) * time.Second
+}
+
+// Save saves the state into the etcd, bounding the call by a timeout
+// derived from ttlSec.
 func (e *Etcd) Save(state []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.defaultTimeout())
+	defer cancel()
+	return e.SaveCtx(ctx, state)
+}
+
+// SaveCtx saves the state into the etcd. Unlike Save, it takes the
+// caller's context into every etcd call, so a cancelled or expired
+// ctx aborts in-flight state persistence instead of blocking forever
+// on a stuck etcd leader.
+func (e *Etcd) SaveCtx(ctx context.Context, state []byte) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	ctx := context.TODO()
 	put := clientv3.OpPut(e.statePath, string(state))
+retry:
 	resp, err := e.client.Txn(ctx).If(e.lock.IsOwner()).Then(put).Commit()
 	if err != nil {
 		return err
 	}
 
 	if !resp.Succeeded {
+		if !e.leading {
+			// This instance is not the leader: a standby created by
+			// NewEtcdTry that is still campaigning, or a former leader
+			// whose attempt to reacquire the lock failed. Report
+			// ErrNotLeader instead of blocking here to seize the lock,
+			// which would defeat the point of running as a standby.
+			return ErrNotLeader
+		}
+
 		log.Errorln("No longer owns the lock, trying to lock and save again.")
-		sess, err := concurrency.NewSession(e.client, concurrency.WithTTL(e.ttlSec))
+		e.leading = false
+		e.notifyLeaderCh(false)
+
+		leaseID, err := e.leases.Grant(ctx, e.ttlSec)
+		if err != nil {
+			return err
+		}
+		sess, err := concurrency.NewSession(e.client, concurrency.WithLease(leaseID), concurrency.WithContext(ctx))
 		if err != nil {
 			return err
 		}
 
+		oldSess := e.sess
+		e.sess = sess
 		e.lock = concurrency.NewMutex(sess, e.lockPath)
 		log.Infof("Try to acquire lock at %s.", e.lockPath)
-		err = e.lock.Lock(context.TODO())
+		err = e.lock.Lock(ctx)
 		if err != nil {
 			return err
 		}
 		log.Infof("Successfully acquired lock at %s.", e.lockPath)
-		return e.Save(state)
+		if err := oldSess.Close(); err != nil {
+			log.Errorln(err)
+		}
+		e.leading = true
+		e.notifyLeaderCh(true)
+		// Retry in place: calling SaveCtx again would block forever on
+		// e.mu, which this call still holds.
+		goto retry
 	}
 
 	return nil
 }
 
-// Load loads the state from etcd.
+// Load loads the state from etcd, bounding the call by a timeout
+// derived from ttlSec.
 func (e *Etcd) Load() ([]byte, error) {
-	e.mu.Lock()
-	ctx := context.TODO()
-	get := clientv3.OpGet(e.statePath)
+	ctx, cancel := context.WithTimeout(context.Background(), e.defaultTimeout())
+	defer cancel()
+	return e.LoadCtx(ctx)
+}
 
-	resp, err := e.client.Txn(ctx).If(e.lock.IsOwner()).Then(get).Commit()
-	if err != nil {
-		return nil, err
-	}
+// LoadCtx loads the state from etcd. Unlike Load, it takes the
+// caller's context into every etcd call, so a cancelled or expired
+// ctx aborts recovery instead of blocking forever on a stuck etcd
+// leader.
+func (e *Etcd) LoadCtx(ctx context.Context) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-	if !resp.Succeeded {
-		log.Errorln("No longer owns the lock, trying to lock and load again.")
-		sess, err := concurrency.NewSession(e.client)
+	for {
+		get := clientv3.OpGet(e.statePath)
+		resp, err := e.client.Txn(ctx).If(e.lock.IsOwner()).Then(get).Commit()
 		if err != nil {
 			return nil, err
 		}
 
-		e.lock = concurrency.NewMutex(sess, e.lockPath)
-		err = e.lock.Lock(context.TODO())
-		e.mu.Unlock()
-		if err != nil {
-			return nil, err
+		if !resp.Succeeded {
+			if !e.leading {
+				// This instance is not the leader: a standby created
+				// by NewEtcdTry that is still campaigning, or a former
+				// leader whose attempt to reacquire the lock failed.
+				// Report ErrNotLeader instead of blocking here to seize
+				// the lock, which would defeat the point of running as
+				// a standby.
+				return nil, ErrNotLeader
+			}
+
+			log.Errorln("No longer owns the lock, trying to lock and load again.")
+			e.leading = false
+			e.notifyLeaderCh(false)
+
+			leaseID, err := e.leases.Grant(ctx, e.ttlSec)
+			if err != nil {
+				return nil, err
+			}
+			sess, err := concurrency.NewSession(e.client, concurrency.WithLease(leaseID), concurrency.WithContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+
+			oldSess := e.sess
+			e.sess = sess
+			e.lock = concurrency.NewMutex(sess, e.lockPath)
+			if err := e.lock.Lock(ctx); err != nil {
+				return nil, err
+			}
+			log.Infof("Successfully acquired lock at %s.", e.lockPath)
+			if err := oldSess.Close(); err != nil {
+				log.Errorln(err)
+			}
+			e.leading = true
+			e.notifyLeaderCh(true)
+			continue
 		}
 
-		return e.Load()
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 {
+			// No state exists
+			return nil, nil
+		}
+
+		return kvs[0].Value, nil
 	}
+}
 
-	kvs := resp.Responses[0].GetResponseRange().Kvs
-	if len(kvs) == 0 {
-		// No state exists
-		e.mu.Unlock()
-		return nil, nil
+// Watch streams the master state over the returned channel whenever
+// it changes. A standby master (see NewEtcdTry) can subscribe to keep
+// an in-memory task queue warm, so that when the primary dies the new
+// leader can recover from memory instead of a cold Load(). The
+// channel is closed when ctx is done or the watch cannot be resumed.
+func (e *Etcd) Watch(ctx context.Context) (<-chan []byte, error) {
+	// Read with a plain client.Get rather than LoadCtx: LoadCtx gates
+	// on e.lock.IsOwner(), so on a standby it returns ErrNotLeader, and
+	// on a leader that lost the lock it seizes the lock again as a side
+	// effect. Neither is wanted when merely subscribing to state for
+	// warm replication.
+	resp, err := e.client.Get(ctx, e.statePath)
+	if err != nil {
+		return nil, err
 	}
+	rev := resp.Header.Revision
 
-	state := kvs[0].Value
-	e.mu.Unlock()
-	return state, nil
+	stateCh := make(chan []byte, 1)
+	if len(resp.Kvs) > 0 {
+		stateCh <- resp.Kvs[0].Value
+	}
+
+	go e.watchState(ctx, rev, stateCh)
+	return stateCh, nil
+}
+
+// watchState runs the etcd watch loop backing Watch. On ErrCompacted
+// it falls back to a fresh read of statePath (a plain client.Get, as
+// in Watch) and resumes watching from the revision of that read.
+func (e *Etcd) watchState(ctx context.Context, rev int64, stateCh chan<- []byte) {
+	defer close(stateCh)
+
+	for {
+		wch := e.client.Watch(ctx, e.statePath, clientv3.WithRev(rev+1))
+		for wresp := range wch {
+			if err := wresp.Err(); err != nil {
+				if err == clientv3.ErrCompacted {
+					log.Errorln("Watch compacted, re-reading state and resuming.")
+					break
+				}
+				log.Errorln(err)
+				return
+			}
+
+			for _, ev := range wresp.Events {
+				select {
+				case stateCh <- ev.Kv.Value:
+				case <-ctx.Done():
+					return
+				}
+			}
+			rev = wresp.Header.Revision
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		resp, err := e.client.Get(ctx, e.statePath)
+		if err != nil {
+			log.Errorln(err)
+			return
+		}
+		if len(resp.Kvs) > 0 {
+			select {
+			case stateCh <- resp.Kvs[0].Value:
+			case <-ctx.Done():
+				return
+			}
+		}
+		rev = resp.Header.Revision
+	}
 }
@@ -0,0 +1,169 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	log "github.com/sirupsen/logrus"
+)
+
+// etcdMaxKeysPerLease bounds how many keys a single LeaseManager
+// lease is allowed to carry before a new lease is allocated.
+const etcdMaxKeysPerLease = 1000
+
+// managedLease tracks one lease and how many keys are currently
+// attached to it.
+type managedLease struct {
+	id       clientv3.LeaseID
+	keyCount int
+}
+
+// LeaseManager maintains a small pool of keep-alive leases shared by
+// many keys, instead of allocating one lease per key. This lets the
+// task scheduler register large numbers of ephemeral keys, e.g.
+// per-trainer registrations or per-task ownership records, that
+// vanish automatically if the owning process dies, without exhausting
+// etcd's lease limit.
+type LeaseManager struct {
+	client *clientv3.Client
+
+	mu     sync.Mutex
+	leases []*managedLease
+	keys   map[string]*managedLease
+}
+
+// NewLeaseManager creates a LeaseManager backed by client.
+func NewLeaseManager(client *clientv3.Client) *LeaseManager {
+	return &LeaseManager{
+		client: client,
+		keys:   make(map[string]*managedLease),
+	}
+}
+
+// Grant allocates a new standalone lease with a ttlSec-second TTL and
+// keeps it alive for as long as client is open. Unlike Attach, the
+// returned lease is not pooled: it is meant for callers, such as
+// master.Etcd's lock session, that need a dedicated lease of their
+// own rather than sharing one with other keys.
+func (m *LeaseManager) Grant(ctx context.Context, ttlSec int) (clientv3.LeaseID, error) {
+	resp, err := m.client.Grant(ctx, int64(ttlSec))
+	if err != nil {
+		return 0, err
+	}
+
+	ch, err := m.client.KeepAlive(context.Background(), resp.ID)
+	if err != nil {
+		return 0, err
+	}
+	go drainKeepAlive(resp.ID, ch)
+
+	return resp.ID, nil
+}
+
+// Attach puts key/value under a lease managed by the LeaseManager,
+// reusing a lease with spare capacity or allocating a new one when
+// every existing lease already carries etcdMaxKeysPerLease keys. The
+// key, and every other key sharing its lease, is deleted by etcd if
+// the lease is not kept alive, e.g. because the owning trainer died.
+func (m *LeaseManager) Attach(ctx context.Context, key, value string) (clientv3.LeaseID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[key]; ok {
+		return 0, fmt.Errorf("master: key %s is already attached", key)
+	}
+
+	ml, err := m.leaseWithSpareCapacityLocked(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := m.client.Put(ctx, key, value, clientv3.WithLease(ml.id)); err != nil {
+		return 0, err
+	}
+
+	ml.keyCount++
+	m.keys[key] = ml
+	return ml.id, nil
+}
+
+// leaseWithSpareCapacityLocked returns a pooled lease with room for
+// another key, allocating and keeping alive a new one if none of the
+// existing leases has spare capacity. m.mu must be held.
+func (m *LeaseManager) leaseWithSpareCapacityLocked(ctx context.Context) (*managedLease, error) {
+	if ml := pickLeaseWithSpareCapacity(m.leases); ml != nil {
+		return ml, nil
+	}
+
+	id, err := m.Grant(ctx, defaultLeaseTTLSec)
+	if err != nil {
+		return nil, err
+	}
+
+	ml := &managedLease{id: id}
+	m.leases = append(m.leases, ml)
+	return ml, nil
+}
+
+// pickLeaseWithSpareCapacity returns the first lease in leases with
+// room for another key, or nil if every lease already carries
+// etcdMaxKeysPerLease keys.
+func pickLeaseWithSpareCapacity(leases []*managedLease) *managedLease {
+	for _, ml := range leases {
+		if ml.keyCount < etcdMaxKeysPerLease {
+			return ml
+		}
+	}
+	return nil
+}
+
+// Release detaches key from its lease and deletes it. When a lease's
+// last key is released, the lease itself is revoked.
+func (m *LeaseManager) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ml, ok := m.keys[key]
+	if !ok {
+		return nil
+	}
+	delete(m.keys, key)
+
+	if _, err := m.client.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	ml.keyCount--
+	m.leases = removeLeaseIfEmpty(m.leases, ml)
+	if ml.keyCount > 0 {
+		return nil
+	}
+
+	_, err := m.client.Revoke(ctx, ml.id)
+	return err
+}
+
+// removeLeaseIfEmpty drops ml from leases if it has no keys attached
+// anymore, leaving leases unchanged otherwise.
+func removeLeaseIfEmpty(leases []*managedLease, ml *managedLease) []*managedLease {
+	if ml.keyCount > 0 {
+		return leases
+	}
+	for i, l := range leases {
+		if l == ml {
+			return append(leases[:i], leases[i+1:]...)
+		}
+	}
+	return leases
+}
+
+// drainKeepAlive discards keep-alive responses so the etcd client
+// keeps renewing the lease; it returns once the channel is closed,
+// which happens when the lease expires or is revoked.
+func drainKeepAlive(id clientv3.LeaseID, ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range ch {
+	}
+	log.Infof("Lease %x is no longer kept alive.", id)
+}
@@ -0,0 +1,70 @@
+package master
+
+import "testing"
+
+func TestPickLeaseWithSpareCapacity(t *testing.T) {
+	if ml := pickLeaseWithSpareCapacity(nil); ml != nil {
+		t.Errorf("expected nil for an empty pool, got %v", ml)
+	}
+
+	full := &managedLease{id: 1, keyCount: etcdMaxKeysPerLease}
+	if ml := pickLeaseWithSpareCapacity([]*managedLease{full}); ml != nil {
+		t.Errorf("expected nil when every lease is full, got %v", ml)
+	}
+
+	spare := &managedLease{id: 2, keyCount: etcdMaxKeysPerLease - 1}
+	leases := []*managedLease{full, spare}
+	if ml := pickLeaseWithSpareCapacity(leases); ml != spare {
+		t.Errorf("expected the lease with spare capacity, got %v", ml)
+	}
+}
+
+func TestRemoveLeaseIfEmpty(t *testing.T) {
+	a := &managedLease{id: 1, keyCount: 1}
+	b := &managedLease{id: 2, keyCount: 0}
+	leases := []*managedLease{a, b}
+
+	leases = removeLeaseIfEmpty(leases, a)
+	if len(leases) != 2 {
+		t.Fatalf("expected a non-empty lease to stay in the pool, got %v", leases)
+	}
+
+	leases = removeLeaseIfEmpty(leases, b)
+	if len(leases) != 1 || leases[0] != a {
+		t.Fatalf("expected the empty lease to be removed, got %v", leases)
+	}
+}
+
+// TestLeaseManagerAttachReleaseBookkeeping replays by hand the
+// bookkeeping steps that Attach and Release perform, without calling
+// them, since both need a live etcd client.
+func TestLeaseManagerAttachReleaseBookkeeping(t *testing.T) {
+	ml := &managedLease{id: 1}
+	m := &LeaseManager{
+		leases: []*managedLease{ml},
+		keys:   make(map[string]*managedLease),
+	}
+
+	ml.keyCount++
+	m.keys["/trainer/1"] = ml
+	ml.keyCount++
+	m.keys["/trainer/2"] = ml
+
+	if ml.keyCount != 2 {
+		t.Fatalf("expected keyCount 2 after two attaches, got %d", ml.keyCount)
+	}
+
+	delete(m.keys, "/trainer/1")
+	ml.keyCount--
+	m.leases = removeLeaseIfEmpty(m.leases, ml)
+	if len(m.leases) != 1 {
+		t.Fatalf("expected the lease to stay pooled while a key remains, got %v", m.leases)
+	}
+
+	delete(m.keys, "/trainer/2")
+	ml.keyCount--
+	m.leases = removeLeaseIfEmpty(m.leases, ml)
+	if len(m.leases) != 0 {
+		t.Fatalf("expected the lease to be dropped once its last key is released, got %v", m.leases)
+	}
+}